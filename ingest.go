@@ -0,0 +1,230 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamessanford/remote-tsdb-clickhouse/internal/clickhouse"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// timestampDefault governs how samples without an explicit timestamp are
+// handled by the Prometheus text format / Pushgateway ingestion endpoints.
+type timestampDefault int
+
+const (
+	timestampDefaultNow timestampDefault = iota
+	timestampDefaultReject
+)
+
+func parseTimestampDefault(s string) (timestampDefault, error) {
+	switch s {
+	case "now":
+		return timestampDefaultNow, nil
+	case "reject":
+		return timestampDefaultReject, nil
+	default:
+		return 0, fmt.Errorf("invalid -ingest.timestamp-default %q, want now or reject", s)
+	}
+}
+
+// decodeExpfmtBody reads a Prometheus text exposition body, transparently
+// gunzipping it if Content-Encoding says so, and parses it into metric
+// families. This uses expfmt.TextParser, which understands the classic
+// Prometheus text format; per its own documentation it "may often succeed"
+// on OpenMetrics input due to the similarity between the formats, but does
+// not implement OpenMetrics features such as the "# EOF" terminator,
+// "_created" lines, or exemplars. Genuine OpenMetrics support would require
+// github.com/prometheus/prometheus/model/textparse's OpenMetricsParser.
+func decodeExpfmtBody(r *http.Request) (map[string]*dto.MetricFamily, error) {
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("gzip.NewReader: %w", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(body)
+	if err != nil {
+		return nil, fmt.Errorf("TextToMetricFamilies: %w", err)
+	}
+	return families, nil
+}
+
+// metricFamiliesToTimeSeries converts parsed metric families, plus any
+// Pushgateway-style grouping labels, into prompb.TimeSeries, applying def to
+// samples that have no timestamp.
+func metricFamiliesToTimeSeries(families map[string]*dto.MetricFamily, groupingLabels []prompb.Label, def timestampDefault) ([]prompb.TimeSeries, error) {
+	now := time.Now().UnixMilli()
+
+	var series []prompb.TimeSeries
+	for name, mf := range families {
+		for _, m := range mf.GetMetric() {
+			timestamp := m.GetTimestampMs()
+			if timestamp == 0 {
+				if def == timestampDefaultReject {
+					return nil, fmt.Errorf("metric %q has no timestamp", name)
+				}
+				timestamp = now
+			}
+
+			baseLabels := make([]prompb.Label, 0, len(m.GetLabel())+len(groupingLabels))
+			baseLabels = append(baseLabels, groupingLabels...)
+			for _, l := range m.GetLabel() {
+				baseLabels = append(baseLabels, prompb.Label{Name: l.GetName(), Value: l.GetValue()})
+			}
+
+			expanded, err := expandMetric(name, mf.GetType(), m, baseLabels, timestamp)
+			if err != nil {
+				return nil, fmt.Errorf("metric %q: %w", name, err)
+			}
+			series = append(series, expanded...)
+		}
+	}
+	return series, nil
+}
+
+// expandMetric converts a single metric sample into one or more time
+// series. Counters, gauges and untyped metrics map to a single series;
+// summaries and histograms expand into their _sum/_count/quantile/_bucket
+// component series, matching how Prometheus itself exposes them.
+func expandMetric(name string, t dto.MetricType, m *dto.Metric, baseLabels []prompb.Label, timestamp int64) ([]prompb.TimeSeries, error) {
+	newSeries := func(suffix string, extra *prompb.Label, value float64) prompb.TimeSeries {
+		labels := make([]prompb.Label, 0, len(baseLabels)+2)
+		labels = append(labels, prompb.Label{Name: "__name__", Value: name + suffix})
+		labels = append(labels, baseLabels...)
+		if extra != nil {
+			labels = append(labels, *extra)
+		}
+		return prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Timestamp: timestamp, Value: value}},
+		}
+	}
+
+	switch t {
+	case dto.MetricType_COUNTER:
+		return []prompb.TimeSeries{newSeries("", nil, m.GetCounter().GetValue())}, nil
+	case dto.MetricType_GAUGE:
+		return []prompb.TimeSeries{newSeries("", nil, m.GetGauge().GetValue())}, nil
+	case dto.MetricType_UNTYPED:
+		return []prompb.TimeSeries{newSeries("", nil, m.GetUntyped().GetValue())}, nil
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		out := make([]prompb.TimeSeries, 0, len(s.GetQuantile())+2)
+		out = append(out, newSeries("_sum", nil, s.GetSampleSum()))
+		out = append(out, newSeries("_count", nil, float64(s.GetSampleCount())))
+		for _, q := range s.GetQuantile() {
+			label := prompb.Label{Name: "quantile", Value: formatFloat(q.GetQuantile())}
+			out = append(out, newSeries("", &label, q.GetValue()))
+		}
+		return out, nil
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		out := make([]prompb.TimeSeries, 0, len(h.GetBucket())+2)
+		out = append(out, newSeries("_sum", nil, h.GetSampleSum()))
+		out = append(out, newSeries("_count", nil, float64(h.GetSampleCount())))
+		for _, b := range h.GetBucket() {
+			label := prompb.Label{Name: "le", Value: formatFloat(b.GetUpperBound())}
+			out = append(out, newSeries("_bucket", &label, float64(b.GetCumulativeCount())))
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported metric type %s", t)
+	}
+}
+
+// formatFloat renders a float the way Prometheus itself formats label
+// values like "le" and "quantile".
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// pushgatewayGroupingLabels parses the "job/<job>[/<label>/<value>...]"
+// path segments Pushgateway clients append after the /metrics/ prefix.
+func pushgatewayGroupingLabels(path string) ([]prompb.Label, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "job" {
+		return nil, fmt.Errorf("path must be /metrics/job/<job>[/<label>/<value>...]")
+	}
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("grouping labels must come in name/value pairs")
+	}
+
+	labels := make([]prompb.Label, 0, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		labels = append(labels, prompb.Label{Name: parts[i], Value: parts[i+1]})
+	}
+	return labels, nil
+}
+
+// ErrIngestRateLimited is returned by ingestExpfmt when the tenant has
+// exceeded its configured sample-rate limit.
+var ErrIngestRateLimited = errors.New("ingest: tenant sample rate limit exceeded")
+
+// ingestExpfmt decodes a Prometheus text exposition body from r (see the
+// caveat on decodeExpfmtBody regarding OpenMetrics input), converts it to
+// Prometheus time series and feeds them through the same write pipeline and
+// per-tenant limits as /write.
+func ingestExpfmt(chFactory *clickhouse.Factory, limiters *tenantLimiters, tenant string, r *http.Request, groupingLabels []prompb.Label, def timestampDefault) error {
+	families, err := decodeExpfmtBody(r)
+	if err != nil {
+		return fmt.Errorf("decodeExpfmtBody: %w", err)
+	}
+
+	series, err := metricFamiliesToTimeSeries(families, groupingLabels, def)
+	if err != nil {
+		return fmt.Errorf("metricFamiliesToTimeSeries: %w", err)
+	}
+
+	sampleCount := 0
+	for _, ts := range series {
+		sampleCount += len(ts.Samples)
+	}
+	if !limiters.allowSamples(tenant, sampleCount) {
+		return ErrIngestRateLimited
+	}
+
+	ch, err := chFactory.ForTenant(tenant)
+	if err != nil {
+		return fmt.Errorf("ForTenant: %w", err)
+	}
+
+	if _, err := ch.WriteRequest(r.Context(), &prompb.WriteRequest{Timeseries: series}); err != nil {
+		return fmt.Errorf("WriteRequest: %w", err)
+	}
+	return nil
+}
+
+// isBodyTooLarge reports whether err (or anything it wraps) is the error
+// http.MaxBytesReader produces when a request body exceeds its limit.
+func isBodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// writeIngestError maps an ingestExpfmt error to the matching HTTP status:
+// 429 for a tenant rate-limit hit, 413 for an oversized body, 400 otherwise.
+func writeIngestError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrIngestRateLimited):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case isBodyTooLarge(err):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
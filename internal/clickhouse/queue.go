@@ -0,0 +1,246 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ErrQueueFull is returned by writeQueue.Enqueue when the buffer of the shard
+// a series hashes to is full. Callers should surface this as a 429 so Prometheus retries with
+// its own backoff.
+var ErrQueueFull = errors.New("clickhouse: write queue is full")
+
+const (
+	defaultShards            = 8
+	defaultShardCapacity     = 2500
+	defaultMaxSamplesPerSend = 500
+	defaultFlushDeadline     = 5 * time.Second
+	maxRetries               = 5
+	retryBaseDelay           = 100 * time.Millisecond
+)
+
+var (
+	queueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "queue_length",
+		Help: "number of series currently buffered across all write queue shards",
+	}, []string{"tenant"})
+	queueShards = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shards",
+		Help: "number of write queue shards",
+	}, []string{"tenant"})
+	samplesDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "samples_dropped_total",
+		Help: "number of samples dropped because the write queue was full or sending failed permanently",
+	}, []string{"tenant"})
+	sendDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "send_duration_seconds",
+		Help:    "time taken to send a batch of series to clickhouse",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"tenant"})
+	retryTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "retry_total",
+		Help: "number of times a batch send to clickhouse was retried after an error",
+	}, []string{"tenant"})
+)
+
+func init() {
+	prometheus.MustRegister(queueLength)
+	prometheus.MustRegister(queueShards)
+	prometheus.MustRegister(samplesDroppedTotal)
+	prometheus.MustRegister(sendDurationSeconds)
+	prometheus.MustRegister(retryTotal)
+}
+
+// queueOptions configures a writeQueue.
+type queueOptions struct {
+	numShards         int
+	shardCapacity     int
+	maxSamplesPerSend int
+	flushDeadline     time.Duration
+}
+
+func defaultQueueOptions() queueOptions {
+	return queueOptions{
+		numShards:         defaultShards,
+		shardCapacity:     defaultShardCapacity,
+		maxSamplesPerSend: defaultMaxSamplesPerSend,
+		flushDeadline:     defaultFlushDeadline,
+	}
+}
+
+// sendFunc inserts series into ClickHouse and returns the number of samples
+// written.
+type sendFunc func(ctx context.Context, series []prompb.TimeSeries) (int, error)
+
+// writeQueue fans time series out across a fixed number of shards, each
+// owning a goroutine and a bounded buffer, modeled on Prometheus's own
+// remote-write StorageQueueManager. Every shard flushes independently once
+// it accumulates maxSamplesPerSend samples or flushDeadline elapses.
+type writeQueue struct {
+	opts   queueOptions
+	send   sendFunc
+	onSent func(n int)
+	shards []*queueShard
+	tenant string
+}
+
+type queueShard struct {
+	buf  chan prompb.TimeSeries
+	done chan struct{}
+}
+
+func newWriteQueue(send sendFunc, opts queueOptions, tenant string) *writeQueue {
+	q := &writeQueue{
+		opts:   opts,
+		send:   send,
+		shards: make([]*queueShard, opts.numShards),
+		tenant: tenant,
+	}
+	queueShards.WithLabelValues(tenant).Set(float64(opts.numShards))
+
+	for i := range q.shards {
+		s := &queueShard{
+			buf:  make(chan prompb.TimeSeries, opts.shardCapacity),
+			done: make(chan struct{}),
+		}
+		q.shards[i] = s
+		go q.runShard(s)
+	}
+	return q
+}
+
+// setOnSent registers fn to be called with the number of samples in each
+// batch immediately after it is successfully sent to ClickHouse.
+func (q *writeQueue) setOnSent(fn func(n int)) {
+	q.onSent = fn
+}
+
+// Enqueue fans series out across shards by a stable hash of each series'
+// label set, returning the number of samples accepted. It returns
+// ErrQueueFull without blocking if a series' shard buffer is full.
+func (q *writeQueue) Enqueue(ctx context.Context, series []prompb.TimeSeries) (int, error) {
+	accepted := 0
+	for _, ts := range series {
+		shard := q.shards[q.shardFor(ts)]
+		select {
+		case shard.buf <- ts:
+			queueLength.WithLabelValues(q.tenant).Inc()
+			accepted += len(ts.Samples)
+		default:
+			samplesDroppedTotal.WithLabelValues(q.tenant).Add(float64(len(ts.Samples)))
+			return accepted, ErrQueueFull
+		}
+	}
+	return accepted, nil
+}
+
+// shardFor returns a stable shard index for a series, hashing its labels
+// rather than its position so that samples for the same series always land
+// on the same shard and are sent in order.
+func (q *writeQueue) shardFor(ts prompb.TimeSeries) int {
+	labels := append([]prompb.Label(nil), ts.Labels...)
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	h := fnv.New64a()
+	for _, l := range labels {
+		_, _ = h.Write([]byte(l.Name))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(l.Value))
+		_, _ = h.Write([]byte{0})
+	}
+	return int(h.Sum64() % uint64(len(q.shards)))
+}
+
+// Stop waits for every shard's current batch to flush, up to the context
+// deadline.
+func (q *writeQueue) Stop(ctx context.Context) {
+	for _, s := range q.shards {
+		close(s.buf)
+	}
+	for _, s := range q.shards {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *writeQueue) runShard(s *queueShard) {
+	defer close(s.done)
+
+	timer := time.NewTimer(q.opts.flushDeadline)
+	defer timer.Stop()
+
+	batch := make([]prompb.TimeSeries, 0, q.opts.maxSamplesPerSend)
+	samples := 0
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		queueLength.WithLabelValues(q.tenant).Sub(float64(len(batch)))
+		q.sendWithRetry(batch)
+		batch = batch[:0]
+		samples = 0
+	}
+
+	for {
+		select {
+		case ts, ok := <-s.buf:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, ts)
+			samples += len(ts.Samples)
+			if samples >= q.opts.maxSamplesPerSend {
+				flush()
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(q.opts.flushDeadline)
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(q.opts.flushDeadline)
+		}
+	}
+}
+
+// sendWithRetry sends batch to ClickHouse, retrying any error up to
+// maxRetries times with exponential backoff before giving up and dropping
+// the batch. Errors are not classified: permanent errors are retried the
+// same way as transient ones.
+func (q *writeQueue) sendWithRetry(batch []prompb.TimeSeries) {
+	var err error
+	var count int
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			retryTotal.WithLabelValues(q.tenant).Inc()
+			time.Sleep(retryBaseDelay << uint(attempt-1))
+		}
+
+		start := time.Now()
+		count, err = q.send(context.Background(), batch)
+		sendDurationSeconds.WithLabelValues(q.tenant).Observe(time.Since(start).Seconds())
+		if err == nil {
+			if q.onSent != nil && count > 0 {
+				q.onSent(count)
+			}
+			return
+		}
+	}
+
+	dropped := 0
+	for _, ts := range batch {
+		dropped += len(ts.Samples)
+	}
+	samplesDroppedTotal.WithLabelValues(q.tenant).Add(float64(dropped))
+}
@@ -0,0 +1,214 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// samplesPerChunk caps how many samples are packed into a single XOR chunk
+// when streaming a read response, matching Prometheus's own chunk size.
+const samplesPerChunk = 120
+
+type seriesRows struct {
+	labels  []prompb.Label
+	samples []sample
+}
+
+type sample struct {
+	t int64
+	v float64
+}
+
+// ReadRequestStreamed answers a remote-read request one series at a time,
+// XOR-encoding each series' samples into ~samplesPerChunk-sample chunks and
+// invoking emit once per series, rather than building the whole response in
+// memory. All rows of a query are read from ClickHouse and grouped by series
+// before the first series of that query is emitted.
+func (a *ClickHouseAdapter) ReadRequestStreamed(ctx context.Context, req *prompb.ReadRequest, emit func(*prompb.ChunkedReadResponse) error) error {
+	for i, q := range req.Queries {
+		rows, err := a.queryRows(ctx, q)
+		if err != nil {
+			return fmt.Errorf("queryRows: %w", err)
+		}
+
+		for _, series := range rows {
+			chunks, err := encodeChunks(series.samples)
+			if err != nil {
+				return fmt.Errorf("encodeChunks: %w", err)
+			}
+
+			resp := &prompb.ChunkedReadResponse{
+				ChunkedSeries: []*prompb.ChunkedSeries{
+					{
+						Labels: series.labels,
+						Chunks: chunks,
+					},
+				},
+				QueryIndex: int64(i),
+			}
+			if err := emit(resp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// queryRows executes q against ClickHouse and groups the resulting rows by
+// series, in timestamp order, ready for chunk encoding. The table is
+// expected to have a "labels Map(String, String)", "timestamp_ms Int64",
+// and "value Float64" column, ordered by (labels, timestamp_ms).
+func (a *ClickHouseAdapter) queryRows(ctx context.Context, q *prompb.Query) ([]seriesRows, error) {
+	sqlQuery, args := a.buildSelectSQL(q)
+
+	rows, err := a.conn.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("conn.Query: %w", err)
+	}
+	defer rows.Close()
+
+	bySeries := make(map[string]*seriesRows)
+	var order []string
+
+	for rows.Next() {
+		var labels map[string]string
+		var timestampMs int64
+		var value float64
+		if err := rows.Scan(&labels, &timestampMs, &value); err != nil {
+			return nil, fmt.Errorf("rows.Scan: %w", err)
+		}
+
+		key := seriesKey(labels)
+		s, ok := bySeries[key]
+		if !ok {
+			s = &seriesRows{labels: labelsFromMap(labels)}
+			bySeries[key] = s
+			order = append(order, key)
+		}
+		s.samples = append(s.samples, sample{t: timestampMs, v: value})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err: %w", err)
+	}
+
+	result := make([]seriesRows, 0, len(order))
+	for _, key := range order {
+		result = append(result, *bySeries[key])
+	}
+	return result, nil
+}
+
+// buildSelectSQL translates q's matchers and time range into a SELECT
+// against a.table, skipping the adapter's configured ignore-label.
+func (a *ClickHouseAdapter) buildSelectSQL(q *prompb.Query) (string, []interface{}) {
+	where := make([]string, 0, len(q.Matchers)+2)
+	args := make([]interface{}, 0, len(q.Matchers)*2+2)
+
+	for _, m := range q.Matchers {
+		if a.ignoreLabelName != "" && m.Name == a.ignoreLabelName && m.Value == a.ignoreLabelValue {
+			continue
+		}
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			where = append(where, "labels[?] = ?")
+			args = append(args, m.Name, m.Value)
+		case prompb.LabelMatcher_NEQ:
+			where = append(where, "labels[?] != ?")
+			args = append(args, m.Name, m.Value)
+		case prompb.LabelMatcher_RE:
+			where = append(where, "match(labels[?], ?)")
+			args = append(args, m.Name, m.Value)
+		case prompb.LabelMatcher_NRE:
+			where = append(where, "NOT match(labels[?], ?)")
+			args = append(args, m.Name, m.Value)
+		}
+	}
+
+	where = append(where, "timestamp_ms >= ?", "timestamp_ms <= ?")
+	args = append(args, q.StartTimestampMs, q.EndTimestampMs)
+
+	sqlQuery := fmt.Sprintf(
+		"SELECT labels, timestamp_ms, value FROM %s WHERE %s ORDER BY labels, timestamp_ms",
+		a.table, strings.Join(where, " AND "),
+	)
+	return sqlQuery, args
+}
+
+// seriesKey returns a canonical string key for a label set, used to group
+// rows into series regardless of the order ClickHouse returns them in.
+func seriesKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for n := range labels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, n := range names {
+		b.WriteString(n)
+		b.WriteByte('=')
+		b.WriteString(labels[n])
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// labelsFromMap converts a ClickHouse labels map into sorted prompb labels.
+func labelsFromMap(labels map[string]string) []prompb.Label {
+	out := make([]prompb.Label, 0, len(labels))
+	for n, v := range labels {
+		out = append(out, prompb.Label{Name: n, Value: v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// labelsToMap converts prompb labels into the map[string]string shape the
+// labels Map(String, String) column requires.
+func labelsToMap(labels []prompb.Label) map[string]string {
+	out := make(map[string]string, len(labels))
+	for _, l := range labels {
+		out[l.Name] = l.Value
+	}
+	return out
+}
+
+// encodeChunks XOR-encodes samples into chunks of at most samplesPerChunk
+// samples each.
+func encodeChunks(samples []sample) ([]prompb.Chunk, error) {
+	var chunks []prompb.Chunk
+
+	for len(samples) > 0 {
+		n := samplesPerChunk
+		if n > len(samples) {
+			n = len(samples)
+		}
+		group := samples[:n]
+		samples = samples[n:]
+
+		chunk := chunkenc.NewXORChunk()
+		appender, err := chunk.Appender()
+		if err != nil {
+			return nil, fmt.Errorf("Appender: %w", err)
+		}
+		for _, s := range group {
+			// chunkenc.Appender.Append takes a leading start-timestamp arg
+			// (only meaningful for histogram chunks); xorAppender ignores it.
+			appender.Append(0, s.t, s.v)
+		}
+
+		chunks = append(chunks, prompb.Chunk{
+			MinTimeMs: group[0].t,
+			MaxTimeMs: group[n-1].t,
+			Type:      prompb.Chunk_XOR,
+			Data:      chunk.Bytes(),
+		})
+	}
+
+	return chunks, nil
+}
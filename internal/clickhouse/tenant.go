@@ -0,0 +1,164 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTenantIDLength matches the Cortex/Mimir org-ID length limit, and
+// validTenantID accepts a subset of their org-ID charset with no quotes,
+// whitespace, dots, semicolons or slashes, so a tenant ID can never be used
+// to inject SQL via table-template substitution or escape any other
+// per-tenant path built from it.
+const maxTenantIDLength = 150
+
+var validTenantID = regexp.MustCompile(`^[a-zA-Z0-9!_-]+$`)
+
+// ValidateTenantID reports an error if tenant is empty, too long, or
+// contains characters outside [a-zA-Z0-9!_-].
+func ValidateTenantID(tenant string) error {
+	if len(tenant) == 0 {
+		return fmt.Errorf("clickhouse: tenant ID must not be empty")
+	}
+	if len(tenant) > maxTenantIDLength {
+		return fmt.Errorf("clickhouse: tenant ID exceeds %d characters", maxTenantIDLength)
+	}
+	if !validTenantID.MatchString(tenant) {
+		return fmt.Errorf("clickhouse: tenant ID %q contains characters outside [a-zA-Z0-9!_-]", tenant)
+	}
+	return nil
+}
+
+// TenantConfig describes where a single tenant's samples live. When Table is
+// empty, a Factory built with a table template derives it from the template;
+// a Factory built from a tenants file has no template and uses Table as given.
+type TenantConfig struct {
+	Database string
+	Table    string
+	Username string
+	Password string
+}
+
+// Factory builds and caches a ClickHouseAdapter per tenant, so that each
+// X-Scope-OrgID can route to its own database/table/credentials. It is safe
+// for concurrent use.
+type Factory struct {
+	addr string
+
+	mu       sync.Mutex
+	adapters map[string]*ClickHouseAdapter
+
+	tableTemplate string
+	tenants       map[string]TenantConfig
+
+	readIgnoreLabel        string
+	writeMaxSamplesPerSend int
+	writeFlushDeadline     time.Duration
+
+	samplesWrittenHook func(tenant string, n int)
+}
+
+// NewTableTemplateFactory builds a Factory that derives each tenant's table
+// name by substituting "{tenant}" in template, reusing database/username/
+// password for every tenant.
+func NewTableTemplateFactory(addr, database, username, password, template string) *Factory {
+	return &Factory{
+		addr:          addr,
+		adapters:      make(map[string]*ClickHouseAdapter),
+		tableTemplate: template,
+		tenants: map[string]TenantConfig{
+			"": {Database: database, Username: username, Password: password},
+		},
+	}
+}
+
+// NewTenantsFileFactory builds a Factory from an explicit tenant-to-config
+// mapping, typically loaded from a YAML file.
+func NewTenantsFileFactory(addr string, tenants map[string]TenantConfig) *Factory {
+	return &Factory{
+		addr:     addr,
+		adapters: make(map[string]*ClickHouseAdapter),
+		tenants:  tenants,
+	}
+}
+
+// Configure sets the options applied to every tenant's adapter as it is
+// lazily constructed by ForTenant.
+func (f *Factory) Configure(readIgnoreLabel string, writeMaxSamplesPerSend int, writeFlushDeadline time.Duration) {
+	f.readIgnoreLabel = readIgnoreLabel
+	f.writeMaxSamplesPerSend = writeMaxSamplesPerSend
+	f.writeFlushDeadline = writeFlushDeadline
+}
+
+// SetSamplesWrittenHook registers fn to be called with the number of
+// samples actually written to ClickHouse for tenant, each time a batch send
+// succeeds. It applies to every adapter the factory constructs from then on.
+func (f *Factory) SetSamplesWrittenHook(fn func(tenant string, n int)) {
+	f.samplesWrittenHook = fn
+}
+
+// ForTenant returns the ClickHouseAdapter for tenant, constructing and
+// caching it on first use. tenant may be "" when multi-tenancy is disabled.
+func (f *Factory) ForTenant(tenant string) (*ClickHouseAdapter, error) {
+	if tenant != "" {
+		if err := ValidateTenantID(tenant); err != nil {
+			return nil, err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if a, ok := f.adapters[tenant]; ok {
+		return a, nil
+	}
+
+	cfg, ok := f.tenants[tenant]
+	if !ok {
+		if f.tableTemplate == "" {
+			return nil, fmt.Errorf("clickhouse: unknown tenant %q", tenant)
+		}
+		cfg = f.tenants[""]
+	}
+
+	table := cfg.Table
+	if table == "" && f.tableTemplate != "" {
+		table = strings.ReplaceAll(f.tableTemplate, "{tenant}", tenant)
+	}
+
+	a, err := NewClickHouseAdapter(f.addr, cfg.Database, cfg.Username, cfg.Password, table, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("NewClickHouseAdapter(%q): %w", tenant, err)
+	}
+	if f.readIgnoreLabel != "" {
+		a.IgnoreLabelInReadRequests(f.readIgnoreLabel)
+	}
+	if f.samplesWrittenHook != nil {
+		a.SetSamplesWrittenHook(func(n int) { f.samplesWrittenHook(tenant, n) })
+	}
+	if f.writeMaxSamplesPerSend > 0 {
+		a.ConfigureWriteQueue(f.writeMaxSamplesPerSend, f.writeFlushDeadline)
+	}
+
+	f.adapters[tenant] = a
+	return a, nil
+}
+
+// CloseAll closes every adapter the factory has constructed so far,
+// flushing each one's write queue.
+func (f *Factory) CloseAll(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var firstErr error
+	for tenant, a := range f.adapters {
+		if err := a.Close(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("tenant %q: %w", tenant, err)
+		}
+	}
+	return firstErr
+}
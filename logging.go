@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"go.uber.org/zap"
+)
+
+var httpRequestDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "latency of /write and /read requests",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"endpoint", "code"},
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestDuration)
+}
+
+// requestStats is populated by the /write and /read handlers as they decode
+// a request, and consumed by loggingMiddleware once the handler returns.
+type requestStats struct {
+	seriesCount  int
+	sampleCount  int
+	minTimestamp int64
+	maxTimestamp int64
+
+	matchers   string
+	rangeStart int64
+	rangeEnd   int64
+}
+
+func (s *requestStats) observeWriteRequest(req *prompb.WriteRequest) {
+	s.seriesCount = len(req.Timeseries)
+	for _, ts := range req.Timeseries {
+		for _, sample := range ts.Samples {
+			s.sampleCount++
+			if s.minTimestamp == 0 || sample.Timestamp < s.minTimestamp {
+				s.minTimestamp = sample.Timestamp
+			}
+			if sample.Timestamp > s.maxTimestamp {
+				s.maxTimestamp = sample.Timestamp
+			}
+		}
+	}
+}
+
+func (s *requestStats) observeReadRequest(req *prompb.ReadRequest) {
+	if len(req.Queries) == 0 {
+		return
+	}
+	q := req.Queries[0]
+	s.matchers = fmt.Sprintf("%v", q.Matchers)
+	s.rangeStart = q.StartTimestampMs
+	s.rangeEnd = q.EndTimestampMs
+}
+
+type requestStatsKey struct{}
+
+func withRequestStats(ctx context.Context, s *requestStats) context.Context {
+	return context.WithValue(ctx, requestStatsKey{}, s)
+}
+
+func statsFromContext(ctx context.Context) *requestStats {
+	s, _ := ctx.Value(requestStatsKey{}).(*requestStats)
+	if s == nil {
+		return &requestStats{}
+	}
+	return s
+}
+
+// statusResponseWriter records the status code written so loggingMiddleware
+// can report it after the handler returns.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher by forwarding to the wrapped
+// ResponseWriter, so handlers behind this middleware (e.g. streamed
+// remote-read responses) can still flush as they write.
+func (w *statusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the wrapped ResponseWriter to http.ResponseController and
+// similar callers that look past one layer of wrapping.
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// loggingMiddleware wraps the /write and /read handlers in structured
+// per-request logging, sampling successful requests at 1/sampleRate while
+// always logging errors.
+type loggingMiddleware struct {
+	logger     *zap.Logger
+	sampleRate uint64
+	counter    uint64
+}
+
+func newLoggingMiddleware(logger *zap.Logger, sampleRate uint64) *loggingMiddleware {
+	return &loggingMiddleware{logger: logger, sampleRate: sampleRate}
+}
+
+func (m *loggingMiddleware) wrap(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := &requestStats{}
+		r = r.WithContext(withRequestStats(r.Context(), stats))
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		start := time.Now()
+		next(sw, r)
+		duration := time.Since(start)
+
+		httpRequestDuration.WithLabelValues(endpoint, strconv.Itoa(sw.status)).Observe(duration.Seconds())
+		m.maybeLog(endpoint, r, sw.status, duration, stats)
+	}
+}
+
+func (m *loggingMiddleware) maybeLog(endpoint string, r *http.Request, status int, duration time.Duration, stats *requestStats) {
+	isError := status >= 400
+	if !isError {
+		if m.sampleRate > 1 && atomic.AddUint64(&m.counter, 1)%m.sampleRate != 0 {
+			return
+		}
+	}
+
+	fields := []zap.Field{
+		zap.String("endpoint", endpoint),
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.Int("status", status),
+		zap.Duration("duration", duration),
+	}
+	if stats.seriesCount > 0 || stats.sampleCount > 0 {
+		fields = append(fields,
+			zap.Int("series_count", stats.seriesCount),
+			zap.Int("sample_count", stats.sampleCount),
+			zap.Int64("min_timestamp", stats.minTimestamp),
+			zap.Int64("max_timestamp", stats.maxTimestamp),
+		)
+	}
+	if stats.matchers != "" {
+		fields = append(fields,
+			zap.String("matchers", stats.matchers),
+			zap.Int64("range_start", stats.rangeStart),
+			zap.Int64("range_end", stats.rangeEnd),
+		)
+	}
+
+	if isError {
+		m.logger.Error("request", fields...)
+	} else {
+		m.logger.Info("request", fields...)
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jamessanford/remote-tsdb-clickhouse/internal/clickhouse"
 
@@ -17,31 +22,31 @@ import (
 )
 
 var (
-	samplesWrittenTotal = prometheus.NewCounter(
+	samplesWrittenTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "samples_written_total",
 			Help: "number of samples written into clickhouse",
-		})
-	writeRequestsTotal = prometheus.NewCounter(
+		}, []string{"tenant"})
+	writeRequestsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "write_requests_total",
 			Help: "number of hits to write endpoint",
-		})
-	writeErrorsTotal = prometheus.NewCounter(
+		}, []string{"tenant"})
+	writeErrorsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "write_errors_total",
 			Help: "number of errors generated by write endpoint",
-		})
-	readRequestsTotal = prometheus.NewCounter(
+		}, []string{"tenant"})
+	readRequestsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "read_requests_total",
 			Help: "number of hits to read endpoint",
-		})
-	readErrorsTotal = prometheus.NewCounter(
+		}, []string{"tenant"})
+	readErrorsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "read_errors_total",
 			Help: "number of errors generated by read endpoint",
-		})
+		}, []string{"tenant"})
 )
 
 func init() {
@@ -57,6 +62,11 @@ func read(ch *clickhouse.ClickHouseAdapter, w http.ResponseWriter, r *http.Reque
 	if err != nil {
 		return fmt.Errorf("DecodeReadRequest: %w", err)
 	}
+	statsFromContext(r.Context()).observeReadRequest(req)
+
+	if acceptsStreamedChunks(req) {
+		return readStreamed(ch, w, r, req)
+	}
 
 	res, err := ch.ReadRequest(r.Context(), req)
 	if err != nil {
@@ -73,82 +83,303 @@ func read(ch *clickhouse.ClickHouseAdapter, w http.ResponseWriter, r *http.Reque
 	return nil
 }
 
+// tenantFromRequest extracts the tenant ID from the X-Scope-OrgID header. If
+// multitenant is false, every request is treated as the single default
+// tenant ("") regardless of the header.
+func tenantFromRequest(r *http.Request, multitenant bool) (string, error) {
+	if !multitenant {
+		return "", nil
+	}
+	tenant := r.Header.Get(tenantHeader)
+	if tenant == "" {
+		return "", fmt.Errorf("missing %s header", tenantHeader)
+	}
+	if err := clickhouse.ValidateTenantID(tenant); err != nil {
+		return "", fmt.Errorf("invalid %s header: %w", tenantHeader, err)
+	}
+	return tenant, nil
+}
+
+// basicAuth wraps next with HTTP basic-auth, comparing against user/pass in
+// constant time. If user is empty, auth is disabled and next is called
+// directly.
+func basicAuth(user, pass string, next http.HandlerFunc) http.HandlerFunc {
+	if user == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPass, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(gotUser), []byte(user)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(gotPass), []byte(pass)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="remote-tsdb-clickhouse"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
 func main() {
-	var httpAddr string
+	var httpAddr, telemetryAddr string
 	var clickAddr, database, username, password, table string
 	var readRequestIgnoreLabel string
+	var tlsCert, tlsKey string
+	var authUser, authPass string
+	var shutdownTimeout time.Duration
+	var writeMaxSamplesPerSend int
+	var writeFlushDeadline time.Duration
+	var logSampleRate uint64
+	var logLevel string
+	var tableTemplate, tenantsFile string
+	var authMultitenant bool
+	var ingestTimestampDefaultFlag string
 	flag.StringVar(&httpAddr, "http", "9131", "listen on this [address:]port")
+	flag.StringVar(&telemetryAddr, "telemetry.address", "", "if set, serve /metrics on this separate [address:]port instead of -http")
 	flag.StringVar(&clickAddr, "db", "127.0.0.1:9000", "ClickHouse DB at this address:port")
 	flag.StringVar(&database, "db.database", "default", "ClickHouse database")
 	flag.StringVar(&username, "db.username", "default", "ClickHouse username")
 	flag.StringVar(&password, "db.password", "", "ClickHouse password")
 	flag.StringVar(&table, "table", "metrics.samples", "write to this database.tablename")
 	flag.StringVar(&readRequestIgnoreLabel, "read.ignore-label", "remote=clickhouse", "ignore this label in read requests")
+	flag.StringVar(&tlsCert, "tls.cert", "", "TLS certificate file, enables HTTPS when used with -tls.key")
+	flag.StringVar(&tlsKey, "tls.key", "", "TLS key file, enables HTTPS when used with -tls.cert")
+	flag.StringVar(&authUser, "auth.user", "", "if set, require this username via HTTP basic auth on /write, /read, /api/v1/import/prometheus and /metrics/job/")
+	flag.StringVar(&authPass, "auth.pass", "", "password required alongside -auth.user")
+	flag.DurationVar(&shutdownTimeout, "shutdown.timeout", 30*time.Second, "time allowed for in-flight requests to drain on shutdown")
+	flag.IntVar(&writeMaxSamplesPerSend, "write.max-samples-per-send", 500, "flush a write queue shard after it buffers this many samples")
+	flag.DurationVar(&writeFlushDeadline, "write.flush-deadline", 5*time.Second, "flush a write queue shard after this much time even if it is not full")
+	flag.Uint64Var(&logSampleRate, "log.sample-rate", 1, "log 1 out of every N successful requests; errors are always logged")
+	flag.StringVar(&logLevel, "log.level", "production", "zap logger to use: production or development")
+	flag.StringVar(&tableTemplate, "table.template", "", "write each tenant to database.table with {tenant} substituted, e.g. metrics.samples_{tenant} (mutually exclusive with -tenants.file)")
+	flag.StringVar(&tenantsFile, "tenants.file", "", "YAML file mapping tenant IDs to {database, table, username, password} (mutually exclusive with -table.template)")
+	flag.BoolVar(&authMultitenant, "auth.multitenant", false, "require a valid X-Scope-OrgID header on /write, /read, /api/v1/import/prometheus and /metrics/job/")
+	flag.StringVar(&ingestTimestampDefaultFlag, "ingest.timestamp-default", "now", "how to handle Prometheus text format/Pushgateway samples with no timestamp: now or reject")
 	flag.Parse()
 
 	if !strings.Contains(httpAddr, ":") {
 		httpAddr = ":" + httpAddr
 	}
+	if telemetryAddr != "" && !strings.Contains(telemetryAddr, ":") {
+		telemetryAddr = ":" + telemetryAddr
+	}
 
-	logger, err := zap.NewProduction()
+	var logger *zap.Logger
+	var err error
+	if logLevel == "development" {
+		logger, err = zap.NewDevelopment()
+	} else {
+		logger, err = zap.NewProduction()
+	}
 	if err != nil {
 		panic(err)
 	}
 
-	ch, err := clickhouse.NewClickHouseAdapter(clickAddr, database, username, password, table)
+	ingestTimestampDefault, err := parseTimestampDefault(ingestTimestampDefaultFlag)
 	if err != nil {
-		logger.Fatal("NewClickHouseAdapter", zap.Error(err))
+		logger.Fatal("parseTimestampDefault", zap.Error(err))
 	}
 
-	if readRequestIgnoreLabel != "" {
-		ch.IgnoreLabelInReadRequests(readRequestIgnoreLabel)
+	logging := newLoggingMiddleware(logger, logSampleRate)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var chFactory *clickhouse.Factory
+	var limiters *tenantLimiters
+	if tenantsFile != "" {
+		tenants, limits, err := loadTenantsFile(tenantsFile)
+		if err != nil {
+			logger.Fatal("loadTenantsFile", zap.Error(err))
+		}
+		chFactory = clickhouse.NewTenantsFileFactory(clickAddr, tenants)
+		limiters = newTenantLimiters(limits)
+	} else {
+		template := tableTemplate
+		if template == "" {
+			template = table
+		}
+		chFactory = clickhouse.NewTableTemplateFactory(clickAddr, database, username, password, template)
+		limiters = newTenantLimiters(nil)
 	}
+	chFactory.Configure(readRequestIgnoreLabel, writeMaxSamplesPerSend, writeFlushDeadline)
+	chFactory.SetSamplesWrittenHook(func(tenant string, n int) {
+		samplesWrittenTotal.WithLabelValues(tenant).Add(float64(n))
+	})
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		_, _ = io.WriteString(w, "remote-tsdb-clickhouse")
 		r.Body.Close()
 	})
 
-	http.Handle("/metrics", promhttp.Handler())
-
-	http.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
-		writeRequestsTotal.Inc()
+	mux.HandleFunc("/write", basicAuth(authUser, authPass, logging.wrap("write", func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := tenantFromRequest(r, authMultitenant)
+		if err != nil {
+			writeErrorsTotal.WithLabelValues("").Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeRequestsTotal.WithLabelValues(tenant).Inc()
+		limiters.limitBody(w, r, tenant)
 		defer r.Body.Close()
+
 		req, err := DecodeWriteRequest(r.Body)
 		if err != nil {
-			writeErrorsTotal.Inc()
-			logger.Error("DecodeWriteRequest", zap.Error(err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeErrorsTotal.WithLabelValues(tenant).Inc()
+			logger.Error("DecodeWriteRequest", zap.Error(err), zap.String("tenant", tenant))
+			if isBodyTooLarge(err) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
 			return
 		}
-		if count, err := ch.WriteRequest(r.Context(), req); err != nil {
-			writeErrorsTotal.Inc()
-			logger.Error("WriteRequest", zap.Error(err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		} else if count > 0 {
-			samplesWrittenTotal.Add(float64(count))
+		statsFromContext(r.Context()).observeWriteRequest(req)
+
+		if !limiters.allowSamples(tenant, statsFromContext(r.Context()).sampleCount) {
+			writeErrorsTotal.WithLabelValues(tenant).Inc()
+			http.Error(w, "tenant sample rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		ch, err := chFactory.ForTenant(tenant)
+		if err != nil {
+			writeErrorsTotal.WithLabelValues(tenant).Inc()
+			logger.Error("ForTenant", zap.Error(err), zap.String("tenant", tenant))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-	})
 
-	http.HandleFunc("/read", func(w http.ResponseWriter, r *http.Request) {
-		readRequestsTotal.Inc()
+		if _, err := ch.WriteRequest(r.Context(), req); err != nil {
+			writeErrorsTotal.WithLabelValues(tenant).Inc()
+			logger.Error("WriteRequest", zap.Error(err), zap.String("tenant", tenant))
+			if errors.Is(err, clickhouse.ErrQueueFull) {
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+	})))
+
+	mux.HandleFunc("/read", basicAuth(authUser, authPass, logging.wrap("read", func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := tenantFromRequest(r, authMultitenant)
+		if err != nil {
+			readErrorsTotal.WithLabelValues("").Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		readRequestsTotal.WithLabelValues(tenant).Inc()
 		defer r.Body.Close()
+
+		ch, err := chFactory.ForTenant(tenant)
+		if err != nil {
+			readErrorsTotal.WithLabelValues(tenant).Inc()
+			logger.Error("ForTenant", zap.Error(err), zap.String("tenant", tenant))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		if err := read(ch, w, r); err != nil && !errors.Is(err, context.Canceled) {
-			readErrorsTotal.Inc()
-			logger.Error("ReadRequest", zap.Error(err))
+			readErrorsTotal.WithLabelValues(tenant).Inc()
+			logger.Error("ReadRequest", zap.Error(err), zap.String("tenant", tenant))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
-	})
+	})))
+
+	mux.HandleFunc("/api/v1/import/prometheus", basicAuth(authUser, authPass, func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := tenantFromRequest(r, authMultitenant)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limiters.limitBody(w, r, tenant)
+		defer r.Body.Close()
+		if err := ingestExpfmt(chFactory, limiters, tenant, r, nil, ingestTimestampDefault); err != nil {
+			logger.Error("ingestExpfmt", zap.Error(err), zap.String("tenant", tenant))
+			writeIngestError(w, err)
+		}
+	}))
+
+	mux.HandleFunc("/metrics/job/", basicAuth(authUser, authPass, func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := tenantFromRequest(r, authMultitenant)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		groupingLabels, err := pushgatewayGroupingLabels(strings.TrimPrefix(r.URL.Path, "/metrics/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limiters.limitBody(w, r, tenant)
+		defer r.Body.Close()
+		if err := ingestExpfmt(chFactory, limiters, tenant, r, groupingLabels, ingestTimestampDefault); err != nil {
+			logger.Error("ingestExpfmt", zap.Error(err), zap.String("tenant", tenant))
+			writeIngestError(w, err)
+		}
+	}))
+
+	var telemetrySrv *http.Server
+	if telemetryAddr != "" {
+		telemetryMux := http.NewServeMux()
+		telemetryMux.Handle("/metrics", promhttp.Handler())
+		telemetrySrv = &http.Server{Addr: telemetryAddr, Handler: telemetryMux}
+		go func() {
+			logger.Info("listening", zap.String("telemetry.address", telemetryAddr))
+			if err := telemetrySrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("telemetry ListenAndServe", zap.Error(err))
+			}
+		}()
+	} else {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+
+	srv := &http.Server{
+		Addr:    httpAddr,
+		Handler: mux,
+		BaseContext: func(net.Listener) context.Context {
+			return context.Background()
+		},
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		logger.Info("shutting down", zap.Duration("timeout", shutdownTimeout))
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Shutdown", zap.Error(err))
+		}
+		if telemetrySrv != nil {
+			if err := telemetrySrv.Shutdown(shutdownCtx); err != nil {
+				logger.Error("telemetry Shutdown", zap.Error(err))
+			}
+		}
+		if err := chFactory.CloseAll(shutdownCtx); err != nil {
+			logger.Error("ClickHouseAdapter CloseAll", zap.Error(err))
+		}
+	}()
 
 	logger.Info(
 		"listening",
 		zap.String("listen", httpAddr),
 		zap.String("db", clickAddr),
 		zap.String("table", table),
+		zap.Bool("tls", tlsCert != "" && tlsKey != ""),
 	)
 
-	if err := http.ListenAndServe(httpAddr, nil); err != nil {
+	if tlsCert != "" && tlsKey != "" {
+		err = srv.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Fatal("ListenAndServe", zap.Error(err))
 	}
+	<-shutdownDone
 }
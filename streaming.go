@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+
+	"github.com/jamessanford/remote-tsdb-clickhouse/internal/clickhouse"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// castagnoliTable is the CRC-32 polynomial Prometheus's own
+// remote.ChunkedWriter checksums each frame with.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkedReadContentType is negotiated via AcceptedResponseTypes on the
+// incoming prompb.ReadRequest.
+const chunkedReadContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+// acceptsStreamedChunks reports whether the client negotiated
+// STREAMED_XOR_CHUNKS in its read request.
+func acceptsStreamedChunks(req *prompb.ReadRequest) bool {
+	for _, t := range req.AcceptedResponseTypes {
+		if t == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			return true
+		}
+	}
+	return false
+}
+
+// chunkedWriter writes a sequence of prompb.ChunkedReadResponse messages
+// using the same framing as Prometheus's own remote.ChunkedWriter -- a
+// uvarint frame length, a big-endian Castagnoli CRC-32 of the frame, then
+// the frame bytes -- so a real Prometheus server's remote.ChunkedReader can
+// decode the stream. Flushes after each frame so the client can start
+// consuming series before the query finishes.
+type chunkedWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newChunkedWriter(w http.ResponseWriter) (*chunkedWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streamed reads require a flushable ResponseWriter")
+	}
+	return &chunkedWriter{w: w, flusher: flusher}, nil
+}
+
+func (cw *chunkedWriter) WriteResponse(resp *prompb.ChunkedReadResponse) error {
+	b, err := resp.Marshal()
+	if err != nil {
+		return fmt.Errorf("resp.Marshal: %w", err)
+	}
+
+	var lengthPrefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lengthPrefix[:], uint64(len(b)))
+	if _, err := cw.w.Write(lengthPrefix[:n]); err != nil {
+		return fmt.Errorf("write length prefix: %w", err)
+	}
+
+	checksum := crc32.Checksum(b, castagnoliTable)
+	if err := binary.Write(cw.w, binary.BigEndian, checksum); err != nil {
+		return fmt.Errorf("write checksum: %w", err)
+	}
+
+	if _, err := cw.w.Write(b); err != nil {
+		return fmt.Errorf("write frame: %w", err)
+	}
+	cw.flusher.Flush()
+
+	return nil
+}
+
+// readStreamed answers req with STREAMED_XOR_CHUNKS, writing one frame per
+// series rather than buffering the full ReadResponse in memory. Each query's
+// rows are still read and grouped in full before its first frame is written.
+func readStreamed(ch *clickhouse.ClickHouseAdapter, w http.ResponseWriter, r *http.Request, req *prompb.ReadRequest) error {
+	cw, err := newChunkedWriter(w)
+	if err != nil {
+		return fmt.Errorf("newChunkedWriter: %w", err)
+	}
+
+	w.Header().Set("Content-Type", chunkedReadContentType)
+
+	if err := ch.ReadRequestStreamed(r.Context(), req, cw.WriteResponse); err != nil {
+		return fmt.Errorf("ReadRequestStreamed: %w", err)
+	}
+
+	return nil
+}
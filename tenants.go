@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jamessanford/remote-tsdb-clickhouse/internal/clickhouse"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// tenantHeader is the Cortex/Mimir-style header carrying the tenant ID.
+const tenantHeader = "X-Scope-OrgID"
+
+// defaultSampleBurst is the token-bucket burst applied when a tenant
+// doesn't configure sample_burst_limit, sized to absorb one normal
+// remote-write request (Prometheus's own remote-write shards commonly
+// batch a few thousand samples per send) regardless of how low the
+// tenant's steady-state sampleRateLimit is.
+const defaultSampleBurst = 10000
+
+// tenantLimits holds the optional per-tenant rate and size limits loaded
+// from a tenants file.
+type tenantLimits struct {
+	sampleRateLimit  float64 // samples/sec accepted on /write and the text ingestion endpoints, 0 = unlimited
+	sampleBurstLimit float64 // token-bucket burst, 0 = defaultSampleBurst
+	maxBodyBytes     int64   // 0 = unlimited
+}
+
+type tenantFileEntry struct {
+	Database         string  `yaml:"database"`
+	Table            string  `yaml:"table"`
+	Username         string  `yaml:"username"`
+	Password         string  `yaml:"password"`
+	SampleRateLimit  float64 `yaml:"sample_rate_limit"`
+	SampleBurstLimit float64 `yaml:"sample_burst_limit"`
+	MaxBodyBytes     int64   `yaml:"max_body_bytes"`
+}
+
+// loadTenantsFile parses a YAML file mapping tenant IDs to their ClickHouse
+// destination and optional limits.
+func loadTenantsFile(path string) (map[string]clickhouse.TenantConfig, map[string]tenantLimits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ReadFile: %w", err)
+	}
+
+	var raw map[string]tenantFileEntry
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("yaml.Unmarshal: %w", err)
+	}
+
+	tenants := make(map[string]clickhouse.TenantConfig, len(raw))
+	limits := make(map[string]tenantLimits, len(raw))
+	for tenant, e := range raw {
+		tenants[tenant] = clickhouse.TenantConfig{
+			Database: e.Database,
+			Table:    e.Table,
+			Username: e.Username,
+			Password: e.Password,
+		}
+		limits[tenant] = tenantLimits{
+			sampleRateLimit:  e.SampleRateLimit,
+			sampleBurstLimit: e.SampleBurstLimit,
+			maxBodyBytes:     e.MaxBodyBytes,
+		}
+	}
+	return tenants, limits, nil
+}
+
+// tenantLimiters enforces the optional per-tenant sample-rate and body-size
+// limits loaded from the tenants file.
+type tenantLimiters struct {
+	limits map[string]tenantLimits
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newTenantLimiters(limits map[string]tenantLimits) *tenantLimiters {
+	return &tenantLimiters{
+		limits:   limits,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// allowSamples reports whether tenant may ingest n more samples right now,
+// consuming from its token bucket if so.
+func (t *tenantLimiters) allowSamples(tenant string, n int) bool {
+	lim, ok := t.limits[tenant]
+	if !ok || lim.sampleRateLimit <= 0 {
+		return true
+	}
+
+	t.mu.Lock()
+	limiter, ok := t.limiters[tenant]
+	if !ok {
+		burst := int(lim.sampleBurstLimit)
+		if burst <= 0 {
+			burst = defaultSampleBurst
+		}
+		limiter = rate.NewLimiter(rate.Limit(lim.sampleRateLimit), burst)
+		t.limiters[tenant] = limiter
+	}
+	t.mu.Unlock()
+
+	return limiter.AllowN(time.Now(), n)
+}
+
+// maxBodyBytes returns tenant's configured body-size limit, or 0 if
+// unlimited.
+func (t *tenantLimiters) maxBodyBytes(tenant string) int64 {
+	return t.limits[tenant].maxBodyBytes
+}
+
+// limitBody wraps r.Body in http.MaxBytesReader when tenant has a
+// configured body-size limit.
+func (t *tenantLimiters) limitBody(w http.ResponseWriter, r *http.Request, tenant string) {
+	if n := t.maxBodyBytes(tenant); n > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+	}
+}